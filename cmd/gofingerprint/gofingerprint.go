@@ -3,170 +3,1135 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// Probe describes a single HTTP request to issue against a target in order
+// to collect evidence for the Match rules that reference it.
+type Probe struct {
+	Method  string            `json:"method,omitempty" yaml:"method,omitempty"`
+	Path    string            `json:"path,omitempty" yaml:"path,omitempty"`
+	Body    string            `json:"body,omitempty" yaml:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+}
+
+// key identifies a probe by the request it actually makes, so that two
+// rules describing an equivalent probe collapse into a single request.
+func (p Probe) key() string {
+	method := strings.ToUpper(p.Method)
+	if method == "" {
+		method = "GET"
+	}
+	path := p.Path
+	if path == "" {
+		path = "/"
+	}
+	var headerParts []string
+	for name, value := range p.Headers {
+		headerParts = append(headerParts, strings.ToLower(name)+":"+value)
+	}
+	sort.Strings(headerParts)
+	return method + " " + path + "\x00" + p.Body + "\x00" + strings.Join(headerParts, "\x01")
+}
+
+// Match asserts something about the response to Probes[Probe], or - for the
+// tls_jarm/cert_issuer_contains/cert_san_regex fields - about the target's
+// TLS layer instead of any probe. A Match may combine several conditions;
+// all of the conditions it sets must hold for the Match itself to hold.
+type Match struct {
+	Probe    int    `json:"probe" yaml:"probe"`
+	Status   *int   `json:"status,omitempty" yaml:"status,omitempty"`
+	Header   string `json:"header,omitempty" yaml:"header,omitempty"`
+	Contains string `json:"contains,omitempty" yaml:"contains,omitempty"`
+	Body     string `json:"body,omitempty" yaml:"body,omitempty"`
+	Regex    string `json:"regex,omitempty" yaml:"regex,omitempty"`
+
+	TLSJarm            string `json:"tls_jarm,omitempty" yaml:"tls_jarm,omitempty"`
+	CertIssuerContains string `json:"cert_issuer_contains,omitempty" yaml:"cert_issuer_contains,omitempty"`
+	CertSANRegex       string `json:"cert_san_regex,omitempty" yaml:"cert_san_regex,omitempty"`
+
+	regex        *regexp.Regexp
+	certSANRegex *regexp.Regexp
+}
+
+// isTLS reports whether this Match is evidenced by the TLS layer rather
+// than by any of the fingerprint's HTTP probes.
+func (m Match) isTLS() bool {
+	return m.TLSJarm != "" || m.CertIssuerContains != "" || m.CertSANRegex != ""
+}
+
+// describe renders the conditions a Match checks, for reporting which
+// signature triggered a match (e.g. in NDJSON output).
+func (m Match) describe() string {
+	var parts []string
+	if m.Status != nil {
+		parts = append(parts, fmt.Sprintf("status=%d", *m.Status))
+	}
+	if m.Header != "" {
+		parts = append(parts, fmt.Sprintf("header[%s] contains %q", m.Header, m.Contains))
+	} else if m.Contains != "" {
+		parts = append(parts, fmt.Sprintf("contains %q", m.Contains))
+	}
+	if m.Body != "" {
+		parts = append(parts, fmt.Sprintf("body contains %q", m.Body))
+	}
+	if m.Regex != "" {
+		parts = append(parts, fmt.Sprintf("regex %q", m.Regex))
+	}
+	if m.TLSJarm != "" {
+		parts = append(parts, fmt.Sprintf("tls_jarm=%s", m.TLSJarm))
+	}
+	if m.CertIssuerContains != "" {
+		parts = append(parts, fmt.Sprintf("cert_issuer contains %q", m.CertIssuerContains))
+	}
+	if m.CertSANRegex != "" {
+		parts = append(parts, fmt.Sprintf("cert_san matches %q", m.CertSANRegex))
+	}
+	return strings.Join(parts, " AND ")
+}
+
+// Fingerprint is one rule: the probes it needs and the match expression,
+// a disjunction of conjunctions (Matches[i] is AND'd internally, and the
+// outer slice is OR'd), used to decide whether a target runs the service.
+//
+// Fingerprints is the legacy flat body-substring list. Older JSON files
+// that only set name/fingerprint still load correctly: upgradeFingerprint
+// turns them into a single default probe plus one OR'd Match per string.
+//
+// Category is populated when the rule came from a YAML category map
+// (e.g. "cms", "ci", "atlassian"); it's empty for plain JSON rulesets.
 type Fingerprint struct {
 	//identifier of the fingerprint e.g. JIRA,Tomcat,AEM,etc
-	Name string `json:"name"`
+	Name string `json:"name" yaml:"name"`
 	//the actual string used to fingerprint a service or application
-	Fingerprints []string `json:"fingerprint"`
+	Fingerprints []string `json:"fingerprint,omitempty" yaml:"fingerprint,omitempty"`
+
+	Probes  []Probe   `json:"probes,omitempty" yaml:"probes,omitempty"`
+	Matches [][]Match `json:"matches,omitempty" yaml:"matches,omitempty"`
+
+	Category string `json:"-" yaml:"-"`
 }
 
-func matcher(response string, fingerprints []Fingerprint) (Fingerprint, bool) {
-	for _, fingerprint := range fingerprints {
-		for _, search := range fingerprint.Fingerprints {
-			if strings.Contains(response, strings.ToLower(search)) {
-				return fingerprint, true
+// sanitizeBucket strips path separators from a fingerprint name or category
+// before it's used to build an output file path. Both can come straight
+// from a third-party ruleset, so neither is trusted to stay inside the
+// output directory on its own.
+func sanitizeBucket(s string) string {
+	s = strings.ReplaceAll(s, "/", "_")
+	s = strings.ReplaceAll(s, "\\", "_")
+	return s
+}
+
+// bucketName is the output file base name for matches of this fingerprint,
+// letting large scans be triaged by category first.
+func (fp Fingerprint) bucketName() string {
+	name := sanitizeBucket(fp.Name)
+	if fp.Category == "" {
+		return name
+	}
+	return sanitizeBucket(fp.Category) + "_" + name
+}
+
+// upgradeFingerprint fills in any entry still using the legacy flat
+// {name, fingerprint:[...]} shape with the probe/match representation,
+// using badpath/method/body as that entry's implicit probe - the same
+// request every legacy fingerprint used to be tested with - and compiles
+// any regex match rules.
+func upgradeFingerprint(fp *Fingerprint, badpath string, method string, body string) error {
+	if len(fp.Probes) == 0 {
+		fp.Probes = []Probe{{Method: method, Path: badpath, Body: body}}
+	}
+	if len(fp.Matches) == 0 {
+		for _, search := range fp.Fingerprints {
+			fp.Matches = append(fp.Matches, []Match{{Probe: 0, Contains: search}})
+		}
+	}
+	for g := range fp.Matches {
+		for r := range fp.Matches[g] {
+			m := &fp.Matches[g][r]
+			if m.Regex != "" {
+				re, err := regexp.Compile(m.Regex)
+				if err != nil {
+					return fmt.Errorf("fingerprint %q: invalid regex %q: %s", fp.Name, m.Regex, err)
+				}
+				m.regex = re
+			}
+			if m.CertSANRegex != "" {
+				re, err := regexp.Compile(m.CertSANRegex)
+				if err != nil {
+					return fmt.Errorf("fingerprint %q: invalid cert_san_regex %q: %s", fp.Name, m.CertSANRegex, err)
+				}
+				m.certSANRegex = re
 			}
 		}
 	}
-	return Fingerprint{}, false
+	return nil
 }
 
-func fetcher(host string, path string, method string, body string) (string, error) {
-	//normalize host and path so we don't get host//path situations
-	if !strings.HasPrefix(host, "https") {
-		host = "https://" + host
+// loadJSONFingerprints parses the legacy flat JSON shape: a top-level array
+// of fingerprints with no category grouping.
+func loadJSONFingerprints(data []byte, badpath string, method string, body string) ([]Fingerprint, error) {
+	var fingerprints []Fingerprint
+	if err := json.Unmarshal(data, &fingerprints); err != nil {
+		return nil, err
 	}
-	if host[len(host)-1] == '/' {
-		if path[0] == '/' {
-			host = host + path[1:]
-		} else {
-			host = host + path
+	for i := range fingerprints {
+		if err := upgradeFingerprint(&fingerprints[i], badpath, method, body); err != nil {
+			return nil, err
 		}
-	} else {
-		if path[0] == '/' {
-			host = host + path
-		} else {
-			host = host + "/" + path
+	}
+	return fingerprints, nil
+}
+
+// yamlDocument is the on-disk shape of a YAML fingerprints file: a
+// top-level map keyed by category (e.g. "cms", "ci", "atlassian"), plus an
+// optional include directive that pulls in shared category-alias files.
+type yamlDocument struct {
+	Include    []string                 `yaml:"include"`
+	Categories map[string][]Fingerprint `yaml:",inline"`
+}
+
+// loadYAMLCategories parses path and recursively resolves its include
+// directive, returning the merged category -> rules map. visited guards
+// against include cycles.
+func loadYAMLCategories(path string, visited map[string]bool) (map[string][]Fingerprint, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if visited[abs] {
+		return nil, fmt.Errorf("include cycle at %s", path)
+	}
+	visited[abs] = true
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc yamlDocument
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	merged := make(map[string][]Fingerprint)
+	dir := filepath.Dir(path)
+	for _, include := range doc.Include {
+		includePath := include
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(dir, includePath)
+		}
+		included, err := loadYAMLCategories(includePath, visited)
+		if err != nil {
+			return nil, fmt.Errorf("include %q: %s", include, err)
+		}
+		for category, rules := range included {
+			merged[category] = append(merged[category], rules...)
 		}
 	}
-	var resp *http.Response
-	var req *http.Request
-	var err error
-	switch strings.ToLower(method) {
-	case "post":
-		req, err = http.NewRequest("POST", host, bytes.NewBufferString(body))
-	case "get":
-		fallthrough
+	for category, rules := range doc.Categories {
+		merged[category] = append(merged[category], rules...)
+	}
+	return merged, nil
+}
+
+// loadYAMLFingerprints parses a categorized YAML fingerprints file, with
+// its includes, into the flat rule list the rest of the program uses.
+func loadYAMLFingerprints(path string, badpath string, method string, body string) ([]Fingerprint, error) {
+	categories, err := loadYAMLCategories(path, make(map[string]bool))
+	if err != nil {
+		return nil, err
+	}
+	var fingerprints []Fingerprint
+	for category, rules := range categories {
+		for _, fp := range rules {
+			fp.Category = category
+			if err := upgradeFingerprint(&fp, badpath, method, body); err != nil {
+				return nil, err
+			}
+			fingerprints = append(fingerprints, fp)
+		}
+	}
+	return fingerprints, nil
+}
+
+// loadFingerprintFile dispatches to the JSON or YAML loader based on path's
+// extension.
+func loadFingerprintFile(path string, badpath string, method string, body string) ([]Fingerprint, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return loadYAMLFingerprints(path, badpath, method, body)
 	default:
-		req, err = http.NewRequest("GET", host, nil)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return loadJSONFingerprints(data, badpath, method, body)
 	}
-	resp, err = http.DefaultClient.Do(req)
+}
+
+// uniqueProbes flattens the probes referenced by every fingerprint into the
+// deduplicated set that actually needs to be requested from a target.
+func uniqueProbes(fingerprints []Fingerprint) []Probe {
+	seen := make(map[string]bool)
+	var probes []Probe
+	for _, fp := range fingerprints {
+		for _, probe := range fp.Probes {
+			key := probe.key()
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			probes = append(probes, probe)
+		}
+	}
+	return probes
+}
+
+// probeResult is the evidence collected from issuing a single Probe,
+// against which Match rules are evaluated.
+type probeResult struct {
+	status  int
+	headers http.Header
+	body    string
+	dump    string
+}
+
+// tlsInfo is the evidence collected from the TLS layer of a target: the
+// negotiated handshake parameters, the certificate identity, and a
+// JARM-style fingerprint hash, evaluated by the tls_jarm,
+// cert_issuer_contains and cert_san_regex Match fields.
+type tlsInfo struct {
+	version     uint16
+	cipherSuite uint16
+	certSubject string
+	certIssuer  string
+	certSANs    []string
+	jarm        string
+}
+
+func matchOne(m Match, res probeResult, tlsEv tlsInfo, hasTLS bool) bool {
+	if m.isTLS() {
+		if !hasTLS {
+			return false
+		}
+		if m.TLSJarm != "" && tlsEv.jarm != m.TLSJarm {
+			return false
+		}
+		if m.CertIssuerContains != "" && !strings.Contains(strings.ToLower(tlsEv.certIssuer), strings.ToLower(m.CertIssuerContains)) {
+			return false
+		}
+		if m.certSANRegex != nil {
+			matched := false
+			for _, san := range tlsEv.certSANs {
+				if m.certSANRegex.MatchString(san) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+		return true
+	}
+	if m.Status != nil && res.status != *m.Status {
+		return false
+	}
+	if m.Header != "" {
+		value := strings.ToLower(res.headers.Get(m.Header))
+		if value == "" {
+			return false
+		}
+		if m.Contains != "" && !strings.Contains(value, strings.ToLower(m.Contains)) {
+			return false
+		}
+	} else if m.Contains != "" && !strings.Contains(res.dump, strings.ToLower(m.Contains)) {
+		return false
+	}
+	if m.Body != "" && !strings.Contains(res.body, strings.ToLower(m.Body)) {
+		return false
+	}
+	if m.regex != nil && !m.regex.MatchString(res.dump) {
+		return false
+	}
+	return true
+}
+
+// matchesGroup reports whether every Match in group holds, and if so the
+// probe and human-readable signature description of the group that
+// triggered - the probe of the group's first HTTP-backed Match, since
+// that's the one a reader would look at first to understand why the
+// fingerprint matched. Groups made up entirely of TLS-backed Matches
+// report a zero Probe.
+func matchesGroup(fp Fingerprint, group []Match, results map[string]probeResult, tlsEv tlsInfo, hasTLS bool) (Probe, bool, string, bool) {
+	var descriptions []string
+	var triggeringProbe Probe
+	haveProbe := false
+	for _, m := range group {
+		if m.isTLS() {
+			if !matchOne(m, probeResult{}, tlsEv, hasTLS) {
+				return Probe{}, false, "", false
+			}
+			descriptions = append(descriptions, m.describe())
+			continue
+		}
+		if m.Probe < 0 || m.Probe >= len(fp.Probes) {
+			return Probe{}, false, "", false
+		}
+		probe := fp.Probes[m.Probe]
+		res, ok := results[probe.key()]
+		if !ok || !matchOne(m, res, tlsEv, hasTLS) {
+			return Probe{}, false, "", false
+		}
+		if !haveProbe {
+			triggeringProbe = probe
+			haveProbe = true
+		}
+		descriptions = append(descriptions, m.describe())
+	}
+	return triggeringProbe, haveProbe, strings.Join(descriptions, " AND "), true
+}
+
+// matcher finds the first fingerprint whose match expression is satisfied
+// by results and tlsEv, along with the probe and signature description
+// responsible.
+func matcher(results map[string]probeResult, tlsEv tlsInfo, hasTLS bool, fingerprints []Fingerprint) (Fingerprint, Probe, bool, string, bool) {
+	for _, fingerprint := range fingerprints {
+		for _, group := range fingerprint.Matches {
+			if probe, haveProbe, description, ok := matchesGroup(fingerprint, group, results, tlsEv, hasTLS); ok {
+				return fingerprint, probe, haveProbe, description, true
+			}
+		}
+	}
+	return Fingerprint{}, Probe{}, false, "", false
+}
+
+// scanTarget is a single host:port pair discovered by the port scanner that
+// still needs to be fingerprinted.
+type scanTarget struct {
+	host string
+	port int
+}
+
+func (t scanTarget) hostPort() string {
+	return net.JoinHostPort(t.host, strconv.Itoa(t.port))
+}
+
+func buildURL(base string, path string) string {
+	if !strings.Contains(base, "://") {
+		base = "https://" + base
+	}
+	base = strings.TrimSuffix(base, "/")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return base + path
+}
+
+// doProbe issues a single Probe against target, which must already carry a
+// scheme (e.g. "https://example.com" or "http://host:port").
+func doProbe(target string, probe Probe) (probeResult, error) {
+	method := strings.ToUpper(probe.Method)
+	if method == "" {
+		method = "GET"
+	}
+	req, err := http.NewRequest(method, buildURL(target, probe.Path), bytes.NewBufferString(probe.Body))
+	if err != nil {
+		return probeResult{}, err
+	}
+	for name, value := range probe.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", err
+		return probeResult{}, err
 	}
 	defer resp.Body.Close()
-	responseString, err := httputil.DumpResponse(resp, true)
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		return probeResult{}, err
+	}
+	bodyBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return probeResult{}, err
+	}
+	return probeResult{
+		status:  resp.StatusCode,
+		headers: resp.Header,
+		body:    strings.ToLower(string(bodyBytes)),
+		dump:    strings.ToLower(string(dump)),
+	}, nil
+}
+
+// probeHost runs every probe in probes against target and returns the
+// results keyed by probe, skipping probes the target didn't respond to.
+func probeHost(target string, probes []Probe) (map[string]probeResult, error) {
+	results := make(map[string]probeResult)
+	for _, probe := range probes {
+		res, err := doProbe(target, probe)
+		if err != nil {
+			continue
+		}
+		results[probe.key()] = res
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("%s did not respond to any probe", target)
+	}
+	return results, nil
+}
+
+// parsePortSpec turns a comma-separated list of ports and port ranges
+// (e.g. "80,443,8000-8100") into the flat list of ports it describes.
+func parsePortSpec(spec string) ([]int, error) {
+	var ports []int
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "-") {
+			bounds := strings.SplitN(part, "-", 2)
+			start, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %s", part, err)
+			}
+			end, err := strconv.Atoi(bounds[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid port range %q: %s", part, err)
+			}
+			for p := start; p <= end; p++ {
+				ports = append(ports, p)
+			}
+		} else {
+			p, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q: %s", part, err)
+			}
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+// splitHostPortSpec splits a stdin line into its bare host and an optional
+// trailing port-range spec, e.g. "example.com:8000-9000" -> ("example.com", "8000-9000").
+// A bracketed IPv6 literal is unwrapped before the port spec is split off,
+// e.g. "[2001:db8::1]:8000-9000" -> ("2001:db8::1", "8000-9000"); a bare
+// IPv6 literal with no port override (no brackets, multiple colons) is
+// returned whole, since its embedded colons can't be told apart from a
+// port separator.
+func splitHostPortSpec(line string) (host string, portSpec string) {
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "]"); end != -1 {
+			host = line[1:end]
+			if rest := line[end+1:]; strings.HasPrefix(rest, ":") {
+				portSpec = rest[1:]
+			}
+			return host, portSpec
+		}
+	}
+	if strings.Count(line, ":") > 1 {
+		return line, ""
+	}
+	idx := strings.Index(line, ":")
+	if idx == -1 {
+		return line, ""
+	}
+	return line[:idx], line[idx+1:]
+}
+
+// scanOpenPorts performs a TCP connect scan of host across ports and returns
+// the ones that accepted a connection, sorted ascending.
+func scanOpenPorts(host string, ports []int, timeout time.Duration) []int {
+	var mu sync.Mutex
+	var open []int
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 100)
+	for _, port := range ports {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(p int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(p)), timeout)
+			if err != nil {
+				return
+			}
+			conn.Close()
+			mu.Lock()
+			open = append(open, p)
+			mu.Unlock()
+		}(port)
+	}
+	wg.Wait()
+	sort.Ints(open)
+	return open
+}
+
+// detectTLS reports whether host:port completes a TLS handshake, which is
+// used to decide whether to probe it with https or http.
+func detectTLS(host string, port int, timeout time.Duration) bool {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// tlsProbeVariant is one of the ten varied ClientHellos the JARM-style
+// fingerprint issues against a host.
+type tlsProbeVariant struct {
+	minVersion uint16
+	maxVersion uint16
+	ciphers    []uint16
+	alpn       []string
+}
+
+func cipherSuiteIDs() []uint16 {
+	var ids []uint16
+	for _, cs := range tls.CipherSuites() {
+		ids = append(ids, cs.ID)
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		ids = append(ids, cs.ID)
+	}
+	return ids
+}
+
+func reversedCipherSuites(ids []uint16) []uint16 {
+	reversed := make([]uint16, len(ids))
+	for i, id := range ids {
+		reversed[len(ids)-1-i] = id
+	}
+	return reversed
+}
+
+// jarmVariants returns the ten varied TLS client configurations the
+// JARM-style fingerprint probes a target with: each picks a different
+// version range, cipher order and ALPN list. This mirrors the spirit of
+// JARM's probe matrix rather than reproducing it byte-for-byte - Go's
+// crypto/tls client doesn't expose raw ClientHello extension ordering.
+func jarmVariants() []tlsProbeVariant {
+	forward := cipherSuiteIDs()
+	reverse := reversedCipherSuites(forward)
+	return []tlsProbeVariant{
+		{tls.VersionTLS12, tls.VersionTLS12, forward, []string{"http/1.1"}},
+		{tls.VersionTLS12, tls.VersionTLS12, reverse, []string{"http/1.1"}},
+		{tls.VersionTLS12, tls.VersionTLS12, forward, []string{"h2", "http/1.1"}},
+		{tls.VersionTLS12, tls.VersionTLS12, reverse, nil},
+		{tls.VersionTLS11, tls.VersionTLS12, forward, []string{"http/1.1"}},
+		{tls.VersionTLS10, tls.VersionTLS12, forward, nil},
+		{tls.VersionTLS13, tls.VersionTLS13, forward, []string{"h2"}},
+		{tls.VersionTLS13, tls.VersionTLS13, reverse, []string{"http/1.1"}},
+		{tls.VersionTLS10, tls.VersionTLS13, forward, nil},
+		{tls.VersionTLS12, tls.VersionTLS13, reverse, []string{"h2", "http/1.1"}},
+	}
+}
+
+// jarmHash issues jarmVariants()'s ten ClientHellos against host:port,
+// concatenates the server-selected cipher and negotiated ALPN protocol from
+// each response, SHA-256s the joined string, and truncates it to 62 hex
+// characters - the length of a real JARM fingerprint.
+func jarmHash(host string, port int, timeout time.Duration) string {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	var parts []string
+	for _, variant := range jarmVariants() {
+		dialer := &net.Dialer{Timeout: timeout}
+		conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         variant.minVersion,
+			MaxVersion:         variant.maxVersion,
+			CipherSuites:       variant.ciphers,
+			NextProtos:         variant.alpn,
+		})
+		if err != nil {
+			parts = append(parts, "|")
+			continue
+		}
+		state := conn.ConnectionState()
+		parts = append(parts, fmt.Sprintf("%04x-%s", state.CipherSuite, state.NegotiatedProtocol))
+		conn.Close()
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	hash := hex.EncodeToString(sum[:])
+	return hash[:62]
+}
+
+// probeTLSInfo performs a single TLS handshake against host:port to collect
+// the negotiated version/cipher and certificate identity, then builds the
+// JARM-style hash from the ten additional varied handshakes.
+func probeTLSInfo(host string, port int, timeout time.Duration) (tlsInfo, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, strconv.Itoa(port)), &tls.Config{InsecureSkipVerify: true})
 	if err != nil {
-		return "", err
+		return tlsInfo{}, err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	info := tlsInfo{version: state.Version, cipherSuite: state.CipherSuite}
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		info.certSubject = cert.Subject.String()
+		info.certIssuer = cert.Issuer.String()
+		info.certSANs = cert.DNSNames
+	}
+	info.jarm = jarmHash(host, port, timeout)
+	return info, nil
+}
+
+// tlsInfoCache caches probeTLSInfo results per host:port, keyed on the
+// net.JoinHostPort address, so a rule set with many TLS-based signatures
+// doesn't re-handshake ten times per rule.
+var tlsInfoCache sync.Map
+
+type tlsCacheEntry struct {
+	info tlsInfo
+	err  error
+}
+
+func cachedTLSInfo(host string, port int, timeout time.Duration) (tlsInfo, error) {
+	key := net.JoinHostPort(host, strconv.Itoa(port))
+	if cached, ok := tlsInfoCache.Load(key); ok {
+		entry := cached.(tlsCacheEntry)
+		return entry.info, entry.err
+	}
+	info, err := probeTLSInfo(host, port, timeout)
+	tlsInfoCache.Store(key, tlsCacheEntry{info: info, err: err})
+	return info, err
+}
+
+// wantsTLSEvidence reports whether any loaded fingerprint has a TLS-backed
+// Match, so plain http:// targets and rule sets with no TLS signatures can
+// skip TLS probing entirely.
+func wantsTLSEvidence(fingerprints []Fingerprint) bool {
+	for _, fp := range fingerprints {
+		for _, group := range fp.Matches {
+			for _, m := range group {
+				if m.isTLS() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// splitTargetHostPort extracts the host and port a scheme-qualified or bare
+// target resolves to, defaulting to port 443 when none is given.
+func splitTargetHostPort(target string) (string, int) {
+	trimmed := target
+	if idx := strings.Index(trimmed, "://"); idx != -1 {
+		trimmed = trimmed[idx+3:]
+	}
+	trimmed = strings.TrimSuffix(trimmed, "/")
+	host, portStr, err := net.SplitHostPort(trimmed)
+	if err != nil {
+		return trimmed, 443
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 443
+	}
+	return host, port
+}
+
+// matchEvent is one fingerprint match, produced by a worker goroutine and
+// sent to the aggregator over a channel rather than written to shared
+// state directly - the channel send is what actually serializes access to
+// the output writer across every worker.
+type matchEvent struct {
+	bucket           string
+	fingerprint      string
+	host             string
+	url              string
+	matchedProbe     string
+	matchedSignature string
+	status           int
+	timestamp        string
+}
+
+// resultWriter is the pluggable output subsystem selected by -output-format.
+// The streaming formats (ndjson/csv) write and flush each event as it
+// arrives; txt keeps batching into per-bucket files at close, matching the
+// tool's original output.
+type resultWriter interface {
+	write(event matchEvent) error
+	close() error
+}
+
+// txtResultWriter reproduces the original behaviour: one "name.txt" (or
+// "category_name.txt") file per fingerprint bucket, written once scanning
+// finishes.
+type txtResultWriter struct {
+	dir     string
+	buckets map[string][]string
+}
+
+func newTxtResultWriter(dir string) *txtResultWriter {
+	return &txtResultWriter{dir: dir, buckets: make(map[string][]string)}
+}
+
+func (w *txtResultWriter) write(event matchEvent) error {
+	w.buckets[event.bucket] = append(w.buckets[event.bucket], event.fingerprint+"\t"+event.host)
+	return nil
+}
+
+func (w *txtResultWriter) close() error {
+	if _, err := os.Stat(w.dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(w.dir, 0755); err != nil {
+			return err
+		}
+	}
+	for bucket, lines := range w.buckets {
+		f, err := os.Create(filepath.Join(w.dir, bucket+".txt"))
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			if _, err := f.WriteString(line + "\n"); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ndjsonResultWriter emits one JSON object per match to stdout as soon as
+// it's found, so gofingerprint can be piped into downstream tools without
+// waiting for the whole scan to finish.
+type ndjsonResultWriter struct {
+	out *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONResultWriter() *ndjsonResultWriter {
+	out := bufio.NewWriter(os.Stdout)
+	return &ndjsonResultWriter{out: out, enc: json.NewEncoder(out)}
+}
+
+func (w *ndjsonResultWriter) write(event matchEvent) error {
+	record := struct {
+		Host             string `json:"host"`
+		URL              string `json:"url"`
+		Fingerprint      string `json:"fingerprint"`
+		MatchedProbe     string `json:"matched_probe"`
+		MatchedSignature string `json:"matched_signature"`
+		Status           int    `json:"status"`
+		Timestamp        string `json:"timestamp"`
+	}{event.host, event.url, event.fingerprint, event.matchedProbe, event.matchedSignature, event.status, event.timestamp}
+	if err := w.enc.Encode(record); err != nil {
+		return err
+	}
+	return w.out.Flush()
+}
+
+func (w *ndjsonResultWriter) close() error {
+	return w.out.Flush()
+}
+
+// csvResultWriter streams one row per match to stdout, flushing after
+// every row for the same reason ndjsonResultWriter does.
+type csvResultWriter struct {
+	w *csv.Writer
+}
+
+func newCSVResultWriter() (*csvResultWriter, error) {
+	w := csv.NewWriter(os.Stdout)
+	if err := w.Write([]string{"host", "url", "fingerprint", "matched_probe", "matched_signature", "status", "timestamp"}); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return &csvResultWriter{w: w}, w.Error()
+}
+
+func (w *csvResultWriter) write(event matchEvent) error {
+	if err := w.w.Write([]string{event.host, event.url, event.fingerprint, event.matchedProbe, event.matchedSignature, strconv.Itoa(event.status), event.timestamp}); err != nil {
+		return err
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+func (w *csvResultWriter) close() error {
+	return nil
+}
+
+func newResultWriter(format string, outputDir string) (resultWriter, error) {
+	switch format {
+	case "", "txt":
+		return newTxtResultWriter(outputDir), nil
+	case "ndjson", "jsonl":
+		return newNDJSONResultWriter(), nil
+	case "csv":
+		return newCSVResultWriter()
+	default:
+		return nil, fmt.Errorf("unknown -output-format %q", format)
+	}
+}
+
+// fingerprintFileFlag collects every -fingerprints occurrence so operators
+// can layer a community ruleset with a private one.
+type fingerprintFileFlag []string
+
+func (f *fingerprintFileFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *fingerprintFileFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// buildMatchEvent assembles the matchEvent for a match found against
+// target (the scheme-qualified URL a probe was actually issued to), using
+// results to look up the status code the triggering probe got back.
+func buildMatchEvent(fp Fingerprint, probe Probe, haveProbe bool, signature string, host string, target string, results map[string]probeResult) matchEvent {
+	if !haveProbe {
+		return matchEvent{
+			bucket:           fp.bucketName(),
+			fingerprint:      fp.Name,
+			host:             host,
+			url:              target,
+			matchedProbe:     "tls",
+			matchedSignature: signature,
+			timestamp:        time.Now().UTC().Format(time.RFC3339),
+		}
+	}
+	method := strings.ToUpper(probe.Method)
+	if method == "" {
+		method = "GET"
+	}
+	return matchEvent{
+		bucket:           fp.bucketName(),
+		fingerprint:      fp.Name,
+		host:             host,
+		url:              buildURL(target, probe.Path),
+		matchedProbe:     method + " " + probe.Path,
+		matchedSignature: signature,
+		status:           results[probe.key()].status,
+		timestamp:        time.Now().UTC().Format(time.RFC3339),
 	}
-	return strings.ToLower(string(responseString)), nil
 }
 
 func main() {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	var wg sync.WaitGroup
-	domainsToSearch := make(chan string)
-	matchBuckets := make(map[string][]string)
-	var fingerprints []Fingerprint
 	badpath := flag.String("badpath", "/sfdrbdbdb", "The intentional 404 path to hit each target with to get a response.")
-	fingerprintFile := flag.String("fingerprints", "", "JSON file containing fingerprints to search for.")
+	var fingerprintFiles fingerprintFileFlag
+	flag.Var(&fingerprintFiles, "fingerprints", "JSON or YAML file containing fingerprints to search for; repeat to layer multiple rulesets.")
 	workers := flag.Int("workers", 20, "Number of workers to process urls")
-	outputDir := flag.String("output", "./", "Directory to output files")
+	outputDir := flag.String("output", "./", "Directory to output files (txt format only)")
+	outputFormat := flag.String("output-format", "txt", "Output format: txt, ndjson, jsonl, or csv")
 	timeoutPtr := flag.Int("timeout", 10, "timeout for connecting to servers")
 	methodPtr := flag.String("method", "GET", "which HTTP request to make the request with.")
 	bodyPtr := flag.String("body", "", "Data to send in the request body")
+	portsPtr := flag.String("ports", "", "Port range to TCP connect-scan (e.g. 1-1000,8080,8443) for stdin lines that don't carry their own host:port-range.")
 	debug := flag.Bool("debug", false, "Enable to see any errors with fetching targets")
 	flag.Parse()
-	http.DefaultClient.Timeout = time.Duration(*timeoutPtr) * time.Second
-	jsonFile, err := os.Open(*fingerprintFile)
+	timeout := time.Duration(*timeoutPtr) * time.Second
+	http.DefaultClient.Timeout = timeout
+
+	if len(fingerprintFiles) == 0 {
+		log.Fatalln("at least one -fingerprints file is required")
+	}
+	var fingerprints []Fingerprint
+	for _, file := range fingerprintFiles {
+		loaded, err := loadFingerprintFile(file, *badpath, *methodPtr, *bodyPtr)
+		if err != nil {
+			log.Fatalf("Error parsing fingerprints from %s. Check that it is compliant. \n %s \n", file, err)
+		}
+		fingerprints = append(fingerprints, loaded...)
+	}
+	probes := uniqueProbes(fingerprints)
+	needsTLSEvidence := wantsTLSEvidence(fingerprints)
+
+	outputDirectory := *outputDir
+	if !strings.HasSuffix(outputDirectory, "/") {
+		outputDirectory += "/"
+	}
+	writer, err := newResultWriter(*outputFormat, outputDirectory)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer jsonFile.Close()
 
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-	if err := json.Unmarshal(byteValue, &fingerprints); err != nil {
-		log.Fatalf("Error parsing JSON. Check that it is compliant. \n %s \n", err)
+	// The aggregator is the only goroutine that ever touches writer, which is
+	// what serializes concurrent matches instead of every worker racing on a
+	// shared map.
+	matches := make(chan matchEvent)
+	var aggregator sync.WaitGroup
+	aggregator.Add(1)
+	go func() {
+		defer aggregator.Done()
+		for event := range matches {
+			if err := writer.write(event); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	var defaultPorts []int
+	if *portsPtr != "" {
+		defaultPorts, err = parsePortSpec(*portsPtr)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	for i := 0; i < *workers; i++ {
-		wg.Add(1)
-		/*
-			This following goroutine is where the magic happens
-			It pulls domains from the group, sends a GET request, then checks the headers and body for the fingerprints
-			described by the supplied JSON and moves the domain in the matching bucket if a match is found
-		*/
-		go func(fingerprintContainers map[string][]string) {
-			for domain := range domainsToSearch {
-				responseStringBad, err := fetcher(domain, *badpath, *methodPtr, *bodyPtr)
-				responseStringGood, err := fetcher(domain, *badpath, *methodPtr, *bodyPtr)
-				if err == nil {
-					matchedFingerprint, matchFound := matcher(responseStringGood+responseStringBad, fingerprints)
+	if *portsPtr == "" {
+		domainsToSearch := make(chan string)
+		for i := 0; i < *workers; i++ {
+			wg.Add(1)
+			/*
+				This following goroutine is where the magic happens
+				It pulls domains from the group, issues every probe the loaded
+				fingerprints need, and sends a matchEvent to the aggregator if a
+				rule's match expression is satisfied
+			*/
+			go func() {
+				for domain := range domainsToSearch {
+					results, err := probeHost(domain, probes)
+					if err != nil {
+						if *debug {
+							println(err.Error())
+						}
+						continue
+					}
+					var tlsEv tlsInfo
+					hasTLS := false
+					if needsTLSEvidence && !strings.HasPrefix(strings.ToLower(domain), "http://") {
+						host, port := splitTargetHostPort(domain)
+						if info, err := cachedTLSInfo(host, port, timeout); err == nil {
+							tlsEv, hasTLS = info, true
+						}
+					}
+					matchedFingerprint, probe, haveProbe, signature, matchFound := matcher(results, tlsEv, hasTLS, fingerprints)
 					if matchFound {
 						log.Println(matchedFingerprint.Name + " found at " + domain)
-						fingerprintContainers[matchedFingerprint.Name] = append(matchBuckets[matchedFingerprint.Name], domain)
+						matches <- buildMatchEvent(matchedFingerprint, probe, haveProbe, signature, domain, domain, results)
+					}
+				}
+				wg.Done()
+			}()
+		}
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			domainsToSearch <- s.Text()
+		}
+		close(domainsToSearch)
+		wg.Wait()
+	} else {
+		// Port-scan mode: each stdin line is a bare host, or a host:port-range
+		// that overrides -ports for that host. Every open port is probed over
+		// https (if the TLS handshake succeeds) and always also over http,
+		// merging both result sets before being handed to the matcher, so a
+		// single host can land in multiple fingerprint buckets for its
+		// different services.
+		scanTargets := make(chan scanTarget)
+		for i := 0; i < *workers; i++ {
+			wg.Add(1)
+			go func() {
+				for target := range scanTargets {
+					hostPort := target.hostPort()
+					isTLS := detectTLS(target.host, target.port, timeout)
+					schemeTarget := "http://" + hostPort
+					results := make(map[string]probeResult)
+					if isTLS {
+						if r, err := probeHost("https://"+hostPort, probes); err == nil {
+							for k, v := range r {
+								results[k] = v
+							}
+							schemeTarget = "https://" + hostPort
+						}
+					}
+					if r, err := probeHost("http://"+hostPort, probes); err == nil {
+						for k, v := range r {
+							if _, exists := results[k]; !exists {
+								results[k] = v
+							}
+						}
 					}
-				} else {
+					if len(results) == 0 {
+						if *debug {
+							println(hostPort + " did not respond to any probe over http or https")
+						}
+						continue
+					}
+					var tlsEv tlsInfo
+					hasTLS := false
+					if needsTLSEvidence && isTLS {
+						if info, err := cachedTLSInfo(target.host, target.port, timeout); err == nil {
+							tlsEv, hasTLS = info, true
+						}
+					}
+					matchedFingerprint, probe, haveProbe, signature, matchFound := matcher(results, tlsEv, hasTLS, fingerprints)
+					if matchFound {
+						log.Println(matchedFingerprint.Name + " found at " + hostPort)
+						matches <- buildMatchEvent(matchedFingerprint, probe, haveProbe, signature, hostPort, schemeTarget, results)
+					}
+				}
+				wg.Done()
+			}()
+		}
+		s := bufio.NewScanner(os.Stdin)
+		for s.Scan() {
+			line := s.Text()
+			if line == "" {
+				continue
+			}
+			host, portSpec := splitHostPortSpec(line)
+			ports := defaultPorts
+			if portSpec != "" {
+				ports, err = parsePortSpec(portSpec)
+				if err != nil {
 					if *debug {
 						println(err.Error())
 					}
+					continue
 				}
 			}
-			wg.Done()
-		}(matchBuckets)
-	}
-	s := bufio.NewScanner(os.Stdin)
-	for s.Scan() {
-		domainsToSearch <- s.Text()
-	}
-	close(domainsToSearch)
-	wg.Wait()
-	fmt.Println("Writing results to fingerprint files")
-
-	outputDirectory := *outputDir
-	if !strings.HasSuffix(*outputDir, "/") {
-		outputDirectory += "/"
-	}
-
-	if _, err := os.Stat(outputDirectory); os.IsNotExist(err) {
-		errDir := os.MkdirAll(outputDirectory, 0755)
-		if errDir != nil {
-			log.Fatal(err)
-		}
-
-	}
-	for fingerprint := range matchBuckets {
-		f, err := os.Create(outputDirectory + fingerprint + ".txt")
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
-		for _, fingerprintedDomain := range matchBuckets[fingerprint] {
-			_, err := f.WriteString(fingerprintedDomain + "\n")
-			if err != nil {
-				fmt.Println(err.Error())
-				f.Close()
-				return
+			if len(ports) == 0 {
+				if *debug {
+					println(host + " has no ports to scan; pass -ports or a host:port-range")
+				}
+				continue
+			}
+			for _, port := range scanOpenPorts(host, ports, timeout) {
+				scanTargets <- scanTarget{host: host, port: port}
 			}
 		}
-		err = f.Close()
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
+		close(scanTargets)
+		wg.Wait()
+	}
+	close(matches)
+	aggregator.Wait()
+	if err := writer.close(); err != nil {
+		log.Fatalln(err)
 	}
 }